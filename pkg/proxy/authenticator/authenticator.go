@@ -0,0 +1,196 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package authenticator
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"k8s.io/apiserver/pkg/authentication/authenticator"
+	authuser "k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/plugin/pkg/authenticator/token/oidc"
+	"k8s.io/apiserver/plugin/pkg/authenticator/token/webhook"
+	"k8s.io/klog"
+
+	"github.com/jetstack/kube-oidc-proxy/cmd/app/options"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/metrics"
+)
+
+// IssuerExtraKey is the user.Info extra key populated with the issuer of the
+// authenticator that issued the response.
+const IssuerExtraKey = "authenticator.kube-oidc-proxy.io/issuer"
+
+// named wraps a token authenticator with the issuer metadata needed to log
+// and account for which identity provider handled a request.
+type named struct {
+	name   string
+	issuer string
+	auther authenticator.Token
+}
+
+// Cache is a registry of token authenticators - one per configured OIDC
+// issuer, plus an optional Kubernetes-style webhook token authenticator.
+// AuthenticateToken tries each in turn, short-circuiting on the first
+// success.
+type Cache struct {
+	authers  []*named
+	uidClaim string
+}
+
+// New builds a Cache from one or more OIDC issuer configs and an optional
+// webhook token authenticator config. uidClaim, if set, is the claim read as
+// an OIDC identity's UID when it doesn't already have one - see
+// Options.UIDClaim.
+func New(oidcOptionsList []*options.OIDCAuthenticationOptions,
+	webhookOptions *options.TokenAuthenticationWebhookOptions, uidClaim string) (*Cache, error) {
+
+	if len(oidcOptionsList) == 0 {
+		return nil, fmt.Errorf("at least one OIDC issuer must be configured")
+	}
+
+	c := &Cache{uidClaim: uidClaim}
+
+	for _, o := range oidcOptionsList {
+		tokenAuther, err := oidc.New(oidc.Options{
+			APIAudiences:         o.APIAudiences,
+			CAFile:               o.CAFile,
+			ClientID:             o.ClientID,
+			GroupsClaim:          o.GroupsClaim,
+			GroupsPrefix:         o.GroupsPrefix,
+			IssuerURL:            o.IssuerURL,
+			RequiredClaims:       o.RequiredClaims,
+			SupportedSigningAlgs: o.SigningAlgs,
+			UsernameClaim:        o.UsernameClaim,
+			UsernamePrefix:       o.UsernamePrefix,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to build OIDC authenticator for issuer %q: %s", o.IssuerURL, err)
+		}
+
+		c.authers = append(c.authers, &named{
+			name:   "oidc",
+			issuer: o.IssuerURL,
+			auther: tokenAuther,
+		})
+	}
+
+	if webhookOptions != nil && webhookOptions.ConfigFile != "" {
+		webhookAuther, err := webhook.New(webhookOptions.ConfigFile, webhookOptions.Version,
+			webhookOptions.CacheTTL, webhookOptions.RetryBackoff, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build webhook token authenticator: %s", err)
+		}
+
+		c.authers = append(c.authers, &named{
+			name:   "webhook",
+			issuer: webhookOptions.ConfigFile,
+			auther: webhookAuther,
+		})
+	}
+
+	return c, nil
+}
+
+// AuthenticateToken implements authenticator.Token by trying each
+// configured authenticator in turn, short-circuiting on the first success.
+func (c *Cache) AuthenticateToken(ctx context.Context, token string) (*authenticator.Response, bool, error) {
+	var lastErr error
+
+	for _, a := range c.authers {
+		resp, ok, err := a.auther.AuthenticateToken(ctx, token)
+		if err != nil {
+			klog.V(4).Infof("authenticator %q (issuer=%s) failed to authenticate token: %s", a.name, a.issuer, err)
+			metrics.AuthenticatorAttempts.WithLabelValues(a.name, a.issuer, metrics.AuthenticatorOutcomeFailure).Inc()
+			lastErr = err
+			continue
+		}
+
+		if !ok {
+			metrics.AuthenticatorAttempts.WithLabelValues(a.name, a.issuer, metrics.AuthenticatorOutcomeFailure).Inc()
+			continue
+		}
+
+		klog.V(4).Infof("authenticator %q (issuer=%s) authenticated request", a.name, a.issuer)
+		metrics.AuthenticatorAttempts.WithLabelValues(a.name, a.issuer, metrics.AuthenticatorOutcomeSuccess).Inc()
+		return withIssuer(withUIDClaim(resp, a.name, token, c.uidClaim), a.issuer), true, nil
+	}
+
+	return nil, false, lastErr
+}
+
+// withUIDClaim returns a copy of resp with its user's UID set from uidClaim
+// in token's (already-verified) claims, if authName is "oidc", uidClaim is
+// set, and the user doesn't already have a UID. No-op otherwise.
+func withUIDClaim(resp *authenticator.Response, authName, token, uidClaim string) *authenticator.Response {
+	if authName != "oidc" || uidClaim == "" || resp.User.GetUID() != "" {
+		return resp
+	}
+
+	uid, ok := tokenClaim(token, uidClaim)
+	if !ok {
+		return resp
+	}
+
+	return &authenticator.Response{
+		Audiences: resp.Audiences,
+		User: &authuser.DefaultInfo{
+			Name:   resp.User.GetName(),
+			UID:    uid,
+			Groups: resp.User.GetGroups(),
+			Extra:  resp.User.GetExtra(),
+		},
+	}
+}
+
+// tokenClaim extracts claim as a string from an already-verified JWT's
+// payload, without re-verifying the signature - verification already
+// happened in the authenticator that produced a successful response.
+func tokenClaim(token, claim string) (string, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", false
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		klog.V(4).Infof("failed to decode token payload for claim %q: %s", claim, err)
+		return "", false
+	}
+
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		klog.V(4).Infof("failed to unmarshal token claims for claim %q: %s", claim, err)
+		return "", false
+	}
+
+	v, ok := claims[claim].(string)
+	if !ok || v == "" {
+		return "", false
+	}
+
+	return v, true
+}
+
+// withIssuer returns a copy of resp with IssuerExtraKey set in its user's
+// extra map to issuer.
+func withIssuer(resp *authenticator.Response, issuer string) *authenticator.Response {
+	extra := resp.User.GetExtra()
+
+	newExtra := make(map[string][]string, len(extra)+1)
+	for k, v := range extra {
+		newExtra[k] = v
+	}
+	newExtra[IssuerExtraKey] = []string{issuer}
+
+	return &authenticator.Response{
+		Audiences: resp.Audiences,
+		User: &authuser.DefaultInfo{
+			Name:   resp.User.GetName(),
+			UID:    resp.User.GetUID(),
+			Groups: resp.User.GetGroups(),
+			Extra:  newExtra,
+		},
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package authenticator
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"k8s.io/apiserver/pkg/authentication/authenticator"
+	authuser "k8s.io/apiserver/pkg/authentication/user"
+)
+
+// fakeTokenAuther implements authenticator.Token with a canned response, so
+// Cache.AuthenticateToken can be exercised without standing up a real OIDC
+// issuer or webhook backend.
+type fakeTokenAuther struct {
+	resp *authenticator.Response
+	ok   bool
+	err  error
+}
+
+func (f *fakeTokenAuther) AuthenticateToken(ctx context.Context, token string) (*authenticator.Response, bool, error) {
+	return f.resp, f.ok, f.err
+}
+
+// TestCache_AuthenticateToken_ShortCircuits checks that Cache tries its
+// authenticators in order and returns the first success, without calling
+// authenticators after it.
+func TestCache_AuthenticateToken_ShortCircuits(t *testing.T) {
+	called := false
+	c := &Cache{
+		authers: []*named{
+			{
+				name:   "oidc",
+				issuer: "https://issuer-a.example.com",
+				auther: &fakeTokenAuther{err: errors.New("token not issued by issuer-a")},
+			},
+			{
+				name:   "oidc",
+				issuer: "https://issuer-b.example.com",
+				auther: &fakeTokenAuther{resp: &authenticator.Response{User: &authuser.DefaultInfo{Name: "alice"}}, ok: true},
+			},
+			{
+				// Should never be reached: AuthenticateToken must
+				// short-circuit on the previous authenticator's success.
+				name:   "webhook",
+				auther: &callTrackingAuther{called: &called},
+			},
+		},
+	}
+
+	resp, ok, err := c.AuthenticateToken(context.Background(), "some-token")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !ok {
+		t.Fatal("expected AuthenticateToken to succeed")
+	}
+	if resp.User.GetName() != "alice" {
+		t.Errorf("expected username %q, got %q", "alice", resp.User.GetName())
+	}
+	if called {
+		t.Error("expected the authenticator after the first success not to be called")
+	}
+
+	if vs := resp.User.GetExtra()[IssuerExtraKey]; len(vs) != 1 || vs[0] != "https://issuer-b.example.com" {
+		t.Errorf("expected %s extra to be %q, got %v", IssuerExtraKey, "https://issuer-b.example.com", vs)
+	}
+}
+
+// TestCache_AuthenticateToken_AllFail checks that Cache surfaces the last
+// authenticator's error when every configured authenticator fails.
+func TestCache_AuthenticateToken_AllFail(t *testing.T) {
+	wantErr := errors.New("token not issued by issuer-b")
+	c := &Cache{
+		authers: []*named{
+			{name: "oidc", issuer: "https://issuer-a.example.com", auther: &fakeTokenAuther{err: errors.New("token not issued by issuer-a")}},
+			{name: "oidc", issuer: "https://issuer-b.example.com", auther: &fakeTokenAuther{err: wantErr}},
+		},
+	}
+
+	_, ok, err := c.AuthenticateToken(context.Background(), "some-token")
+	if ok {
+		t.Fatal("expected AuthenticateToken to fail")
+	}
+	if err != wantErr {
+		t.Errorf("expected the last authenticator's error to be returned, got: %s", err)
+	}
+}
+
+// callTrackingAuther records whether it was ever called, for asserting that
+// Cache.AuthenticateToken short-circuits and doesn't call authenticators
+// after the first success.
+type callTrackingAuther struct {
+	called *bool
+}
+
+func (c *callTrackingAuther) AuthenticateToken(ctx context.Context, token string) (*authenticator.Response, bool, error) {
+	*c.called = true
+	return nil, false, nil
+}
+
+// TestWithIssuer checks that withIssuer sets IssuerExtraKey on a copy of the
+// user's extra map without mutating the original response's extra map.
+func TestWithIssuer(t *testing.T) {
+	originalExtra := map[string][]string{"groups": {"system:masters"}}
+	resp := &authenticator.Response{
+		User: &authuser.DefaultInfo{
+			Name:   "alice",
+			UID:    "abc-123",
+			Groups: []string{"system:masters"},
+			Extra:  originalExtra,
+		},
+	}
+
+	got := withIssuer(resp, "https://issuer.example.com")
+
+	if got.User.GetName() != "alice" || got.User.GetUID() != "abc-123" {
+		t.Errorf("expected withIssuer to preserve name/UID, got %+v", got.User)
+	}
+
+	if vs := got.User.GetExtra()[IssuerExtraKey]; len(vs) != 1 || vs[0] != "https://issuer.example.com" {
+		t.Errorf("expected %s extra %q, got %v", IssuerExtraKey, "https://issuer.example.com", vs)
+	}
+
+	if _, ok := originalExtra[IssuerExtraKey]; ok {
+		t.Error("expected withIssuer not to mutate the original response's extra map")
+	}
+}
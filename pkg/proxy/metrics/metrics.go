@@ -0,0 +1,98 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Authentication outcome labels for AuthenticationOutcomes.
+const (
+	OutcomeSuccess               = "success"
+	OutcomeOIDCFailure           = "oidc_failure"
+	OutcomeTokenReviewFailure    = "tokenreview_failure"
+	OutcomeImpersonationRejected = "impersonation_rejected"
+)
+
+// Outcome labels for AuthenticatorAttempts.
+const (
+	AuthenticatorOutcomeSuccess = "success"
+	AuthenticatorOutcomeFailure = "failure"
+)
+
+const namespace = "kube_oidc_proxy"
+
+var (
+	// AuthenticationOutcomes counts every authentication attempt made in
+	// Proxy.RoundTrip, labelled by its outcome and the issuer that
+	// authenticated it. Username is deliberately not a label, despite being
+	// named in the original request for this metric: it is unbounded
+	// cardinality supplied by whoever holds a bearer token, and Prometheus
+	// has no way to evict old label sets.
+	AuthenticationOutcomes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "authentication_outcomes_total",
+		Help:      "Total number of authentication attempts, by outcome.",
+	}, []string{"outcome", "issuer"})
+
+	// UpstreamRequestDuration observes the latency of requests proxied
+	// through to the API server, labelled by issuer only - see
+	// AuthenticationOutcomes for why username is not a label. It also
+	// observes the 429 responses the per-user rate limiter returns without
+	// contacting the API server.
+	UpstreamRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "upstream_request_duration_seconds",
+		Help:      "Latency of requests proxied to the API server.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"issuer"})
+
+	// ResponseCodes counts responses returned to clients by the upstream API
+	// server's status code and issuer - see AuthenticationOutcomes for why
+	// username is not a label. It also counts the 429 responses the per-user
+	// rate limiter returns without contacting the API server.
+	ResponseCodes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "response_codes_total",
+		Help:      "Total number of responses returned to clients, by status code.",
+	}, []string{"code", "issuer"})
+
+	// InFlightRequests is the number of requests currently being proxied to
+	// the API server.
+	InFlightRequests = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "in_flight_requests",
+		Help:      "Number of requests currently being proxied to the API server.",
+	})
+
+	// RateLimitedRequests counts requests rejected by the per-user rate
+	// limiter. Not labelled by username for the same reason as
+	// AuthenticationOutcomes above.
+	RateLimitedRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limited_requests_total",
+		Help:      "Total number of requests rejected by the per-user rate limiter.",
+	})
+
+	// AuthenticatorAttempts counts every attempt made by an individual
+	// authenticator in the authenticator cache's registry (one per configured
+	// OIDC issuer, plus the optional webhook authenticator), labelled by
+	// authenticator name, issuer, and outcome. AuthenticationOutcomes only
+	// records the proxy's overall decision, not which of several configured
+	// authenticators was tried or rejected a given token.
+	AuthenticatorAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "authenticator_attempts_total",
+		Help:      "Total number of authentication attempts made by each configured authenticator, by outcome.",
+	}, []string{"authenticator", "issuer", "outcome"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		AuthenticationOutcomes,
+		UpstreamRequestDuration,
+		ResponseCodes,
+		InFlightRequests,
+		RateLimitedRequests,
+		AuthenticatorAttempts,
+	)
+}
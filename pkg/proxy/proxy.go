@@ -4,23 +4,44 @@ package proxy
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"k8s.io/apimachinery/pkg/util/httpstream"
 	utilnet "k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+	"k8s.io/apiserver/pkg/audit"
+	"k8s.io/apiserver/pkg/audit/policy"
 	"k8s.io/apiserver/pkg/authentication/authenticator"
 	"k8s.io/apiserver/pkg/authentication/request/bearertoken"
+	"k8s.io/apiserver/pkg/authentication/request/x509"
 	authuser "k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/filters"
+	apirequest "k8s.io/apiserver/pkg/endpoints/request"
 	"k8s.io/apiserver/pkg/server"
-	"k8s.io/apiserver/plugin/pkg/authenticator/token/oidc"
+	"k8s.io/apiserver/pkg/server/dynamiccertificates"
+	genericfilters "k8s.io/apiserver/pkg/server/filters"
+	auditlog "k8s.io/apiserver/plugin/pkg/audit/log"
+	auditwebhook "k8s.io/apiserver/plugin/pkg/audit/webhook"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/transport"
+	"k8s.io/client-go/util/flowcontrol"
 	"k8s.io/klog"
 
 	"github.com/jetstack/kube-oidc-proxy/cmd/app/options"
+	authenticatorcache "github.com/jetstack/kube-oidc-proxy/pkg/proxy/authenticator"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/metrics"
 	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/tokenreview"
 )
 
@@ -37,18 +58,90 @@ var (
 	impersonateUserHeader  = strings.ToLower(transport.ImpersonateUserHeader)
 	impersonateGroupHeader = strings.ToLower(transport.ImpersonateGroupHeader)
 	impersonateExtraHeader = strings.ToLower(transport.ImpersonateUserExtraHeaderPrefix)
+
+	// defaultAllowedRequestHeaders are forwarded to the API server for every
+	// request; anything else is stripped unless added via
+	// Options.AllowedRequestHeaders. Includes the SPDY and WebSocket
+	// stream-protocol negotiation headers needed by exec/attach/
+	// port-forward/logs -f upgrade requests.
+	defaultAllowedRequestHeaders = []string{
+		"Accept",
+		"Accept-Encoding",
+		"User-Agent",
+		"Connection",
+		"Upgrade",
+		"Content-Type",
+		"X-Stream-Protocol-Version",
+		"Sec-Websocket-Key",
+		"Sec-Websocket-Version",
+		"Sec-Websocket-Protocol",
+		"Sec-Websocket-Extensions",
+	}
+
+	// hopByHopHeaders are meaningful only between the caller and this proxy,
+	// so they are always stripped, even if present in the allow-list.
+	hopByHopHeaders = []string{
+		"Keep-Alive",
+		"Proxy-Authenticate",
+		"Te",
+		"Trailer",
+		"Transfer-Encoding",
+	}
 )
 
 type Options struct {
 	DisableImpersonation bool
-	TokenReview          bool
+
+	// TokenReview enables the legacy passthrough path that validates a
+	// bearer token via the TokenReview API and forwards it unimpersonated.
+	// Overlaps with, but is independent of, a webhook token authenticator on
+	// the authenticator cache: TokenReview always passes the token through
+	// raw, while the cache's webhook authenticator is impersonated like any
+	// other successful authentication.
+	TokenReview bool
+
+	// PassthroughUIDBearing forwards the original bearer token with no
+	// impersonation headers set when the authenticated identity carries a
+	// UID, since Kubernetes impersonation cannot yet set a UID. The same
+	// passthrough trick Pinniped uses for service account tokens.
+	PassthroughUIDBearing bool
+
+	// UIDClaim is the JWT claim read as the identity's UID when an
+	// OIDC-authenticated identity doesn't already have one - oidc.Options has
+	// no UID-claim mapping of its own. No effect on identities that already
+	// carry a UID, e.g. from the webhook/TokenReview paths.
+	UIDClaim string
+
+	// AuditPolicyFile points to an apiserver audit policy file. When unset,
+	// audit logging is disabled. Mirrors kube-apiserver's --audit-policy-file.
+	AuditPolicyFile string
+	// AuditLogPath is the file audit events are appended to as JSON lines.
+	// Mirrors kube-apiserver's --audit-log-path.
+	AuditLogPath string
+	// AuditWebhookConfigFile is a kubeconfig file identifying the webhook
+	// backend events are sent to. Mirrors kube-apiserver's
+	// --audit-webhook-config-file.
+	AuditWebhookConfigFile string
+	// AuditWebhookInitialBackoff is the initial duration to wait before
+	// retrying a failed audit webhook delivery.
+	AuditWebhookInitialBackoff time.Duration
 
 	ExtraUserHeaders                map[string][]string
 	ExtraUserHeadersClientIPEnabled bool
+
+	// AllowedRequestHeaders extends defaultAllowedRequestHeaders with
+	// additional headers to forward to the API server.
+	AllowedRequestHeaders []string
+
+	// RateLimitQPS and RateLimitBurst configure a per-username token-bucket
+	// rate limiter in RoundTrip. RateLimitQPS of 0 disables rate limiting.
+	RateLimitQPS   float32
+	RateLimitBurst int
 }
 
 type Proxy struct {
 	oidcRequestAuther *bearertoken.Authenticator
+	clientCertAuther  authenticator.Request
 	tokenAuther       authenticator.Token
 	tokenReviewer     *tokenreview.TokenReview
 	secureServingInfo *server.SecureServingInfo
@@ -57,36 +150,56 @@ type Proxy struct {
 	clientTransport       http.RoundTripper
 	noAuthClientTransport http.RoundTripper
 
+	// upgradeClientTransport is a HTTP/1.1-only transport used for requests
+	// that upgrade the connection (exec, attach, port-forward, logs -f).
+	// SPDY and WebSocket upgrades cannot be multiplexed over HTTP/2, so these
+	// requests must bypass the regular clientTransport.
+	upgradeClientTransport http.RoundTripper
+
+	// noAuthUpgradeClientTransport is noAuthClientTransport's HTTP/1.1-only
+	// counterpart, for upgrade requests that take the DisableImpersonation
+	// or PassthroughUIDBearing path instead of being impersonated.
+	noAuthUpgradeClientTransport http.RoundTripper
+
+	// MetricsServingInfo, when set, serves Prometheus metrics on /metrics on
+	// its own listener, separate from the proxy's main TLS port.
+	MetricsServingInfo *server.SecureServingInfo
+
+	// rateLimiters holds one *rateLimiterEntry per authenticated username,
+	// lazily created on first use and swept by sweepRateLimiters.
+	rateLimiters sync.Map
+
 	options *Options
 }
 
-func New(restConfig *rest.Config, oidcOptions *options.OIDCAuthenticationOptions,
+func New(restConfig *rest.Config, oidcOptionsList []*options.OIDCAuthenticationOptions,
+	webhookOptions *options.TokenAuthenticationWebhookOptions,
+	clientCertCAContent dynamiccertificates.CAContentProvider,
 	tokenReviewer *tokenreview.TokenReview, ssinfo *server.SecureServingInfo,
 	options *Options) (*Proxy, error) {
 
-	// generate tokenAuther from oidc config
-	tokenAuther, err := oidc.New(oidc.Options{
-		APIAudiences:         oidcOptions.APIAudiences,
-		CAFile:               oidcOptions.CAFile,
-		ClientID:             oidcOptions.ClientID,
-		GroupsClaim:          oidcOptions.GroupsClaim,
-		GroupsPrefix:         oidcOptions.GroupsPrefix,
-		IssuerURL:            oidcOptions.IssuerURL,
-		RequiredClaims:       oidcOptions.RequiredClaims,
-		SupportedSigningAlgs: oidcOptions.SigningAlgs,
-		UsernameClaim:        oidcOptions.UsernameClaim,
-		UsernamePrefix:       oidcOptions.UsernamePrefix,
-	})
+	// build the token authenticator registry from the configured OIDC
+	// issuers and, optionally, a webhook token authenticator
+	tokenAuther, err := authenticatorcache.New(oidcOptionsList, webhookOptions, options.UIDClaim)
 	if err != nil {
 		return nil, err
 	}
 
+	var clientCertAuther authenticator.Request
+	if clientCertCAContent != nil {
+		// Callers authenticating with a client certificate signed by this CA
+		// are identified as CN=<username>, O=<group>, mirroring the
+		// multi-authenticator front-end used by aggregated API servers.
+		clientCertAuther = x509.NewDynamic(clientCertCAContent.VerifyOptions, x509.CommonNameUserConversion)
+	}
+
 	return &Proxy{
 		restConfig:        restConfig,
 		tokenReviewer:     tokenReviewer,
 		secureServingInfo: ssinfo,
 		options:           options,
 		oidcRequestAuther: bearertoken.New(tokenAuther),
+		clientCertAuther:  clientCertAuther,
 		tokenAuther:       tokenAuther,
 	}, nil
 }
@@ -99,22 +212,44 @@ func (p *Proxy) Run(stopCh <-chan struct{}) (<-chan struct{}, error) {
 	}
 	p.clientTransport = clientRT
 
-	// No auth round tripper for no impersonation
-	if p.options.DisableImpersonation || p.options.TokenReview {
-		noAuthClientRT, err := p.roundTripperForRestConfig(&rest.Config{
-			APIPath: p.restConfig.APIPath,
-			Host:    p.restConfig.Host,
-			Timeout: p.restConfig.Timeout,
-			TLSClientConfig: rest.TLSClientConfig{
-				CAFile: p.restConfig.CAFile,
-				CAData: p.restConfig.CAData,
-			},
-		})
-		if err != nil {
-			return nil, err
-		}
+	// HTTP/1.1-only round tripper for upgrade requests (exec, attach,
+	// port-forward, logs -f) which cannot survive HTTP/2 multiplexing.
+	upgradeRT, err := p.roundTripperForUpgrade(p.restConfig)
+	if err != nil {
+		return nil, err
+	}
+	p.upgradeClientTransport = upgradeRT
+
+	// No auth round tripper for no impersonation. Built unconditionally since
+	// it is also needed for passthrough of UID-bearing tokens, not just
+	// DisableImpersonation/TokenReview.
+	noAuthConfig := &rest.Config{
+		APIPath: p.restConfig.APIPath,
+		Host:    p.restConfig.Host,
+		Timeout: p.restConfig.Timeout,
+		TLSClientConfig: rest.TLSClientConfig{
+			CAFile: p.restConfig.CAFile,
+			CAData: p.restConfig.CAData,
+		},
+	}
+
+	noAuthClientRT, err := p.roundTripperForRestConfig(noAuthConfig)
+	if err != nil {
+		return nil, err
+	}
+	p.noAuthClientTransport = noAuthClientRT
+
+	// HTTP/1.1-only counterpart of noAuthClientTransport, for upgrade
+	// requests on the DisableImpersonation or PassthroughUIDBearing path.
+	noAuthUpgradeRT, err := p.roundTripperForUpgrade(noAuthConfig)
+	if err != nil {
+		return nil, err
+	}
+	p.noAuthUpgradeClientTransport = noAuthUpgradeRT
 
-		p.noAuthClientTransport = noAuthClientRT
+	// Evict idle per-username rate limiters in the background.
+	if p.options.RateLimitQPS > 0 {
+		go p.sweepRateLimiters(stopCh)
 	}
 
 	// get API server url
@@ -128,17 +263,33 @@ func (p *Proxy) Run(stopCh <-chan struct{}) (<-chan struct{}, error) {
 	proxyHandler.Transport = p
 	proxyHandler.ErrorHandler = p.Error
 
-	waitCh, err := p.serve(proxyHandler, stopCh)
+	// wrap the handler chain with the apiserver audit filter, if configured
+	handler, err := p.auditHandler(proxyHandler)
 	if err != nil {
 		return nil, err
 	}
 
+	waitCh, err := p.serve(handler, stopCh)
+	if err != nil {
+		return nil, err
+	}
+
+	// serve Prometheus metrics on their own listener, if configured
+	if p.MetricsServingInfo != nil {
+		metricsHandler := http.NewServeMux()
+		metricsHandler.Handle("/metrics", promhttp.Handler())
+
+		if _, err := p.MetricsServingInfo.Serve(metricsHandler, time.Second*60, stopCh); err != nil {
+			return nil, err
+		}
+	}
+
 	return waitCh, nil
 }
 
-func (p *Proxy) serve(proxyHandler *httputil.ReverseProxy, stopCh <-chan struct{}) (<-chan struct{}, error) {
+func (p *Proxy) serve(handler http.Handler, stopCh <-chan struct{}) (<-chan struct{}, error) {
 	// securely serve using serving config
-	waitCh, err := p.secureServingInfo.Serve(proxyHandler, time.Second*60, stopCh)
+	waitCh, err := p.secureServingInfo.Serve(handler, time.Second*60, stopCh)
 	if err != nil {
 		return nil, err
 	}
@@ -146,45 +297,197 @@ func (p *Proxy) serve(proxyHandler *httputil.ReverseProxy, stopCh <-chan struct{
 	return waitCh, nil
 }
 
+// auditHandler wraps handler with the standard apiserver audit filter so
+// every proxied request emits a structured audit event. Returns handler
+// unchanged, with audit logging disabled, when no AuditPolicyFile is set.
+func (p *Proxy) auditHandler(handler http.Handler) (http.Handler, error) {
+	if p.options.AuditPolicyFile == "" {
+		return handler, nil
+	}
+
+	auditPolicy, err := policy.LoadPolicyFromFile(p.options.AuditPolicyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load audit policy file %q: %s", p.options.AuditPolicyFile, err)
+	}
+	ruleEvaluator := policy.NewPolicyRuleEvaluator(auditPolicy)
+
+	var backends []audit.Backend
+
+	if p.options.AuditLogPath != "" {
+		logBackend, err := auditlog.NewBackend(p.options.AuditLogPath, auditlog.FormatJson, auditv1.SchemeGroupVersion)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create audit log backend: %s", err)
+		}
+		backends = append(backends, logBackend)
+	}
+
+	if p.options.AuditWebhookConfigFile != "" {
+		webhookBackend, err := auditwebhook.NewBackend(p.options.AuditWebhookConfigFile,
+			auditv1.SchemeGroupVersion, wait.Backoff{Duration: p.options.AuditWebhookInitialBackoff, Steps: 5})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create audit webhook backend: %s", err)
+		}
+		backends = append(backends, webhookBackend)
+	}
+
+	// a policy file with no backends configured is a no-op rather than an error
+	if len(backends) == 0 {
+		return handler, nil
+	}
+
+	// WithAudit needs a RequestInfo in context to populate verb/resource on
+	// the audit event and for policy rules scoped to a resource to match, and
+	// a long-running check so watch/exec/attach/port-forward requests get a
+	// ResponseStarted-stage event when their response begins, instead of
+	// waiting for the upgraded connection to close.
+	handler = filters.WithAudit(handler, audit.Union(backends...), ruleEvaluator, longRunningRequestCheck)
+	handler = filters.WithRequestInfo(handler, requestInfoResolver)
+
+	return handler, nil
+}
+
+// requestInfoResolver mirrors the resolver kube-apiserver installs ahead of
+// its own audit and authorization filters, so RequestInfo on a proxied
+// request looks the same as it would on the API server itself.
+var requestInfoResolver = &apirequest.RequestInfoFactory{
+	APIPrefixes:          sets.NewString("api", "apis"),
+	GrouplessAPIPrefixes: sets.NewString("api"),
+}
+
+// longRunningRequestCheck matches kube-apiserver's default long-running verbs
+// and subresources (watch, exec, attach, port-forward, log, proxy), so those
+// requests also emit an audit ResponseStarted event when their response
+// begins, rather than being treated as a normal short-lived request.
+var longRunningRequestCheck = genericfilters.BasicLongRunningRequestCheck(
+	sets.NewString("watch", "proxy"),
+	sets.NewString("attach", "exec", "proxy", "log", "portforward"),
+)
+
+// RoundTrip authenticates and impersonates req, instrumenting the attempt
+// with in-flight, latency, and response code metrics before delegating the
+// actual work to authenticateAndRoundTrip.
 func (p *Proxy) RoundTrip(req *http.Request) (*http.Response, error) {
+	metrics.InFlightRequests.Inc()
+	defer metrics.InFlightRequests.Dec()
+
+	start := time.Now()
+
+	resp, _, issuer, err := p.authenticateAndRoundTrip(req)
+	if err == nil && resp != nil {
+		metrics.ResponseCodes.WithLabelValues(strconv.Itoa(resp.StatusCode), issuer).Inc()
+		metrics.UpstreamRequestDuration.WithLabelValues(issuer).Observe(time.Since(start).Seconds())
+	}
+
+	return resp, err
+}
+
+// authenticateAndRoundTrip returns, alongside the proxied response, the
+// username and issuer of the identity that authenticated the request.
+// RoundTrip labels its metrics with the issuer only.
+func (p *Proxy) authenticateAndRoundTrip(req *http.Request) (resp *http.Response, username, issuer string, err error) {
 	// Clone the request here since successfully authenticating the request
 	// deletes those auth headers
 	reqCpy := utilnet.CloneRequest(req)
 
+	// If the caller presented a TLS client certificate that validates against
+	// the configured CA, authenticate them from the certificate subject
+	// instead of going through the OIDC bearer token path. A certificate that
+	// fails to validate against the CA is not a hard failure here - the
+	// caller may still be carrying a valid OIDC bearer token, so we fall
+	// through to the OIDC path rather than rejecting outright.
+	if p.clientCertAuther != nil && reqCpy.TLS != nil && len(reqCpy.TLS.PeerCertificates) > 0 {
+		info, ok, certErr := p.clientCertAuther.AuthenticateRequest(reqCpy)
+		if certErr != nil {
+			klog.V(2).Infof("client certificate AuthenticateRequest failed with err: %s", certErr)
+		} else if ok {
+			username, issuer = usernameAndIssuer(info.User)
+			resp, err = p.roundTripWithIdentity(req, reqCpy, info.User)
+			return resp, username, issuer, err
+		}
+	}
+
 	// auth request and handle unauthed
 	info, ok, err := p.oidcRequestAuther.AuthenticateRequest(reqCpy)
 	klog.V(2).Infof("AuthenticateRequest failed with err: %s", err)
 	if err != nil {
+		metrics.AuthenticationOutcomes.WithLabelValues(metrics.OutcomeOIDCFailure, "").Inc()
 
 		// attempt to passthrough request if valid token
 		if p.options.TokenReview {
-			return p.tokenReview(reqCpy)
+			resp, err = p.tokenReview(reqCpy)
+			return resp, "", "tokenreview", err
 		}
 
-		return nil, errUnauthorized
+		return nil, "", "", errUnauthorized
 	}
 
 	// failed authorization
 	if !ok {
-		return nil, errUnauthorized
+		metrics.AuthenticationOutcomes.WithLabelValues(metrics.OutcomeOIDCFailure, "").Inc()
+		return nil, "", "", errUnauthorized
 	}
 
 	klog.V(4).Infof("authenticated request: %s", reqCpy.RemoteAddr)
 
+	username, issuer = usernameAndIssuer(info.User)
+	resp, err = p.roundTripWithIdentity(req, reqCpy, info.User)
+	return resp, username, issuer, err
+}
+
+// usernameAndIssuer returns user's name and, if present, the issuer recorded
+// in its IssuerExtraKey extra value.
+func usernameAndIssuer(user authuser.Info) (username, issuer string) {
+	if vs := user.GetExtra()[authenticatorcache.IssuerExtraKey]; len(vs) > 0 {
+		issuer = vs[0]
+	}
+
+	return user.GetName(), issuer
+}
+
+// roundTripWithIdentity impersonates the given authenticated identity and
+// pushes the request on to the API server. It is shared by the OIDC and
+// client certificate authentication paths.
+func (p *Proxy) roundTripWithIdentity(req, reqCpy *http.Request, user authuser.Info) (*http.Response, error) {
+	// Record the authenticated identity on the request's audit event. Audit
+	// events are created before RoundTrip runs, so the original event has no
+	// user populated until we fill it in here.
+	auditAuthenticatedUser(reqCpy, user)
+
+	// Rate limit and count every named identity up front, before dispatching
+	// to whichever path handles the request - otherwise the
+	// DisableImpersonation and PassthroughUIDBearing passthrough paths below
+	// would bypass rate limiting and success metrics entirely.
+	if user.GetName() != "" {
+		if resp := p.rateLimitResponse(req, user.GetName()); resp != nil {
+			return resp, nil
+		}
+
+		_, issuer := usernameAndIssuer(user)
+		metrics.AuthenticationOutcomes.WithLabelValues(metrics.OutcomeSuccess, issuer).Inc()
+	}
+
 	// if we have disabled impersonation we can forward the request right away
 	if p.options.DisableImpersonation {
 		klog.V(2).Infof("passing on request with no impersonation: %s", reqCpy.RemoteAddr)
 		// Send original copy here with auth header intact
-		return p.noAuthClientTransport.RoundTrip(req)
+		return p.noAuthRoundTripperFor(reqCpy).RoundTrip(req)
+	}
+
+	// Kubernetes impersonation cannot yet carry a UID, so if the identity has
+	// one (e.g. a projected service account token), forward the original
+	// bearer token untouched rather than impersonating and losing it.
+	if p.options.PassthroughUIDBearing && user.GetUID() != "" {
+		klog.V(2).Infof("passing on request with UID-bearing token with no impersonation: %s", reqCpy.RemoteAddr)
+		return p.noAuthRoundTripperFor(reqCpy).RoundTrip(req)
 	}
 
 	// check for incoming impersonation headers and reject if any exists
 	if p.hasImpersonation(reqCpy.Header) {
+		_, issuer := usernameAndIssuer(user)
+		metrics.AuthenticationOutcomes.WithLabelValues(metrics.OutcomeImpersonationRejected, issuer).Inc()
 		return nil, errImpersonateHeader
 	}
 
-	user := info.User
-
 	// no name available so reject request
 	if user.GetName() == "" {
 		return nil, errNoName
@@ -228,6 +531,11 @@ func (p *Proxy) RoundTrip(req *http.Request) (*http.Response, error) {
 		}
 	}
 
+	// Strip everything but the allow-listed headers, plus hop-by-hop headers
+	// and any Authorization remnants, before the request reaches the
+	// impersonating round tripper.
+	p.filterHeaders(reqCpy.Header)
+
 	// Set impersonation header using authenticated user identity.
 	conf := transport.ImpersonationConfig{
 		UserName: user.GetName(),
@@ -235,12 +543,47 @@ func (p *Proxy) RoundTrip(req *http.Request) (*http.Response, error) {
 		Extra:    extra,
 	}
 
-	rt := transport.NewImpersonatingRoundTripper(conf, p.clientTransport)
+	auditImpersonatedUser(reqCpy, conf)
+
+	rt := transport.NewImpersonatingRoundTripper(conf, p.clientRoundTripperFor(reqCpy))
 
 	// push request through round trippers to the API server
 	return rt.RoundTrip(reqCpy)
 }
 
+// clientRoundTripperFor returns the HTTP/1.1-only upgrade transport for
+// requests that upgrade the connection (exec, attach, port-forward,
+// logs -f), and the regular transport otherwise.
+func (p *Proxy) clientRoundTripperFor(req *http.Request) http.RoundTripper {
+	if httpstream.IsUpgradeRequest(req) {
+		klog.V(4).Infof("routing upgrade request through HTTP/1.1 transport: %s", req.RemoteAddr)
+		return p.upgradeClientTransport
+	}
+
+	return p.clientTransport
+}
+
+// noAuthRoundTripperFor is clientRoundTripperFor's counterpart for the
+// no-impersonation paths (DisableImpersonation, PassthroughUIDBearing,
+// TokenReview).
+func (p *Proxy) noAuthRoundTripperFor(req *http.Request) http.RoundTripper {
+	if httpstream.IsUpgradeRequest(req) {
+		klog.V(4).Infof("routing upgrade request through HTTP/1.1 no-auth transport: %s", req.RemoteAddr)
+		return p.noAuthUpgradeClientTransport
+	}
+
+	return p.noAuthClientTransport
+}
+
+// tokenReview validates req's bearer token via the legacy TokenReview
+// passthrough path and forwards it unimpersonated on success.
+//
+// Unlike the OIDC and client certificate paths, this does not call
+// auditAuthenticatedUser: p.tokenReviewer.Review only reports whether the
+// token was valid, not the identity behind it. Audit events on this path are
+// emitted with no user populated - a known gap, out of scope here, that
+// would need pkg/proxy/tokenreview to expose the TokenReview response's
+// Status.User.
 func (p *Proxy) tokenReview(req *http.Request) (*http.Response, error) {
 	klog.V(4).Infof("attempting to validate a token in request using TokenReview endpoint(%s)",
 		req.RemoteAddr)
@@ -250,9 +593,10 @@ func (p *Proxy) tokenReview(req *http.Request) (*http.Response, error) {
 	if err == nil && ok {
 		klog.V(4).Infof("passing request with valid token through (%s)",
 			req.RemoteAddr)
+		metrics.AuthenticationOutcomes.WithLabelValues(metrics.OutcomeSuccess, "tokenreview").Inc()
 		// Don't set impersonation headers and pass through without proxy auth
 		// and headers still set
-		return p.noAuthClientTransport.RoundTrip(req)
+		return p.noAuthRoundTripperFor(req).RoundTrip(req)
 	}
 
 	if err != nil {
@@ -260,9 +604,143 @@ func (p *Proxy) tokenReview(req *http.Request) (*http.Response, error) {
 			req.RemoteAddr, err)
 	}
 
+	metrics.AuthenticationOutcomes.WithLabelValues(metrics.OutcomeTokenReviewFailure, "tokenreview").Inc()
+
 	return nil, errUnauthorized
 }
 
+// auditAuthenticatedUser records the identity authenticated by the OIDC,
+// client certificate, or webhook path onto the request's audit event.
+func auditAuthenticatedUser(req *http.Request, user authuser.Info) {
+	ev := audit.AuditEventFrom(req.Context())
+	if ev == nil {
+		return
+	}
+
+	extra := make(map[string]auditv1.ExtraValue, len(user.GetExtra()))
+	for k, v := range user.GetExtra() {
+		extra[k] = v
+	}
+
+	ev.User = auditv1.UserInfo{
+		Username: user.GetName(),
+		UID:      user.GetUID(),
+		Groups:   user.GetGroups(),
+		Extra:    extra,
+	}
+}
+
+// auditImpersonatedUser records the identity the proxy is impersonating to
+// the API server onto the request's audit event.
+func auditImpersonatedUser(req *http.Request, conf transport.ImpersonationConfig) {
+	ev := audit.AuditEventFrom(req.Context())
+	if ev == nil {
+		return
+	}
+
+	ev.ImpersonatedUser = &auditv1.UserInfo{
+		Username: conf.UserName,
+		Groups:   conf.Groups,
+	}
+}
+
+// rateLimiterIdleTimeout and rateLimiterSweepInterval bound how long an
+// idle per-username entry is kept in Proxy.rateLimiters before
+// sweepRateLimiters evicts it.
+const (
+	rateLimiterIdleTimeout   = 10 * time.Minute
+	rateLimiterSweepInterval = time.Minute
+)
+
+// rateLimiterEntry pairs a per-username rate limiter with the time it was
+// last used, for sweepRateLimiters to evict once idle.
+type rateLimiterEntry struct {
+	limiter  flowcontrol.RateLimiter
+	lastUsed int64 // unix nanoseconds, accessed atomically
+}
+
+// sweepRateLimiters periodically evicts rateLimiters entries that haven't
+// been used in rateLimiterIdleTimeout.
+func (p *Proxy) sweepRateLimiters(stopCh <-chan struct{}) {
+	wait.Until(func() {
+		cutoff := time.Now().Add(-rateLimiterIdleTimeout).UnixNano()
+
+		p.rateLimiters.Range(func(key, value interface{}) bool {
+			entry := value.(*rateLimiterEntry)
+			if atomic.LoadInt64(&entry.lastUsed) < cutoff {
+				p.rateLimiters.Delete(key)
+			}
+			return true
+		})
+	}, rateLimiterSweepInterval, stopCh)
+}
+
+// rateLimitResponse enforces the per-username token-bucket rate limit. It
+// returns nil if the request should proceed, or a 429 response with a
+// Retry-After header if the username has exceeded its QPS/burst allowance.
+// Rate limiting is disabled entirely when Options.RateLimitQPS is 0.
+func (p *Proxy) rateLimitResponse(req *http.Request, username string) *http.Response {
+	if p.options.RateLimitQPS <= 0 {
+		return nil
+	}
+
+	entryIface, _ := p.rateLimiters.LoadOrStore(username, &rateLimiterEntry{
+		limiter: flowcontrol.NewTokenBucketRateLimiter(p.options.RateLimitQPS, p.options.RateLimitBurst),
+	})
+	entry := entryIface.(*rateLimiterEntry)
+	atomic.StoreInt64(&entry.lastUsed, time.Now().UnixNano())
+
+	if entry.limiter.TryAccept() {
+		return nil
+	}
+
+	metrics.RateLimitedRequests.Inc()
+	klog.V(2).Infof("rate limit exceeded for user %q: %s", username, req.RemoteAddr)
+
+	const retryAfter = "1"
+	header := make(http.Header)
+	header.Set("Retry-After", retryAfter)
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+
+	body := "Too Many Requests"
+	return &http.Response{
+		Status:        http.StatusText(http.StatusTooManyRequests),
+		StatusCode:    http.StatusTooManyRequests,
+		Proto:         req.Proto,
+		ProtoMajor:    req.ProtoMajor,
+		ProtoMinor:    req.ProtoMinor,
+		Header:        header,
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+// filterHeaders strips every header not explicitly allow-listed (via
+// defaultAllowedRequestHeaders or Options.AllowedRequestHeaders), then
+// removes standard hop-by-hop headers and any Authorization remnants as
+// defence in depth, even if one was added to the allow-list.
+func (p *Proxy) filterHeaders(header http.Header) {
+	allowed := make(map[string]bool, len(defaultAllowedRequestHeaders)+len(p.options.AllowedRequestHeaders))
+	for _, h := range defaultAllowedRequestHeaders {
+		allowed[strings.ToLower(h)] = true
+	}
+	for _, h := range p.options.AllowedRequestHeaders {
+		allowed[strings.ToLower(h)] = true
+	}
+
+	for h := range header {
+		if !allowed[strings.ToLower(h)] {
+			header.Del(h)
+		}
+	}
+
+	for _, h := range hopByHopHeaders {
+		header.Del(h)
+	}
+	header.Del("Authorization")
+}
+
 func (p *Proxy) hasImpersonation(header http.Header) bool {
 	for h := range header {
 		if strings.ToLower(h) == impersonateUserHeader ||
@@ -338,6 +816,38 @@ func (p *Proxy) roundTripperForRestConfig(config *rest.Config) (http.RoundTrippe
 	return clientRT, nil
 }
 
+// roundTripperForUpgrade builds a transport identical to
+// roundTripperForRestConfig's except that it is restricted to HTTP/1.1, since
+// SPDY and WebSocket upgrades used by exec/attach/port-forward/logs -f cannot
+// survive HTTP/2 multiplexing.
+func (p *Proxy) roundTripperForUpgrade(config *rest.Config) (http.RoundTripper, error) {
+	tlsConfig, err := rest.TLSConfigFor(config)
+	if err != nil {
+		return nil, err
+	}
+
+	// Restrict ALPN negotiation to HTTP/1.1 only.
+	if tlsConfig != nil {
+		tlsConfig.NextProtos = []string{"http/1.1"}
+	}
+
+	tlsTransport := &http.Transport{
+		TLSClientConfig: tlsConfig,
+	}
+
+	restTransportConfig, err := config.TransportConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	upgradeRT, err := transport.HTTPWrappersForConfig(restTransportConfig, tlsTransport)
+	if err != nil {
+		return nil, err
+	}
+
+	return upgradeRT, nil
+}
+
 // Return the proxy OIDC token authenticator
 func (p *Proxy) OIDCTokenAuthenticator() authenticator.Token {
 	return p.tokenAuther
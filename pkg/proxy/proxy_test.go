@@ -0,0 +1,360 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+	"k8s.io/apiserver/pkg/audit"
+	"k8s.io/apiserver/pkg/authentication/authenticator"
+	"k8s.io/apiserver/pkg/authentication/request/bearertoken"
+	authuser "k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/client-go/transport"
+
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/metrics"
+)
+
+// fakeRoundTripper records whether it was called and returns a canned
+// response, so tests can assert which transport a request was routed
+// through without making a real network call.
+type fakeRoundTripper struct {
+	called bool
+	resp   *http.Response
+}
+
+func (f *fakeRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	f.called = true
+	return f.resp, nil
+}
+
+func newFakeRoundTripper() *fakeRoundTripper {
+	return &fakeRoundTripper{resp: &http.Response{StatusCode: http.StatusOK}}
+}
+
+// fakeRequestAuther implements authenticator.Request and returns a fixed
+// response, for standing in for the client certificate authenticator.
+type fakeRequestAuther struct {
+	resp *authenticator.Response
+	ok   bool
+	err  error
+}
+
+func (f *fakeRequestAuther) AuthenticateRequest(req *http.Request) (*authenticator.Response, bool, error) {
+	return f.resp, f.ok, f.err
+}
+
+// fakeTokenAuther implements authenticator.Token and always authenticates
+// successfully as user, for standing in for the OIDC token authenticator
+// behind bearertoken.Authenticator.
+type fakeTokenAuther struct {
+	user authuser.Info
+}
+
+func (f *fakeTokenAuther) AuthenticateToken(ctx context.Context, token string) (*authenticator.Response, bool, error) {
+	return &authenticator.Response{User: f.user}, true, nil
+}
+
+func newFakeBearerAuther(t *testing.T, user authuser.Info) *bearertoken.Authenticator {
+	t.Helper()
+	return bearertoken.New(&fakeTokenAuther{user: user})
+}
+
+// testTransports groups the four round trippers a Proxy threads requests
+// through, so tests can assert exactly which one a given request reached.
+type testTransports struct {
+	client        *fakeRoundTripper
+	upgrade       *fakeRoundTripper
+	noAuth        *fakeRoundTripper
+	noAuthUpgrade *fakeRoundTripper
+}
+
+func newTestProxy() (*Proxy, *testTransports) {
+	rts := &testTransports{
+		client:        newFakeRoundTripper(),
+		upgrade:       newFakeRoundTripper(),
+		noAuth:        newFakeRoundTripper(),
+		noAuthUpgrade: newFakeRoundTripper(),
+	}
+
+	return &Proxy{
+		clientTransport:              rts.client,
+		upgradeClientTransport:       rts.upgrade,
+		noAuthClientTransport:        rts.noAuth,
+		noAuthUpgradeClientTransport: rts.noAuthUpgrade,
+		options:                      &Options{},
+	}, rts
+}
+
+// TestFilterHeaders checks that the default allow-list keeps the
+// SPDY/WebSocket stream-protocol headers needed for exec/attach/
+// port-forward/logs -f, strips anything not allow-listed, and always strips
+// hop-by-hop headers and Authorization.
+func TestFilterHeaders(t *testing.T) {
+	p := &Proxy{options: &Options{}}
+
+	header := http.Header{}
+	header.Set("Accept", "application/json")
+	header.Set("X-Stream-Protocol-Version", "v4.channel.k8s.io")
+	header.Set("Sec-Websocket-Protocol", "v4.channel.k8s.io")
+	header.Set("Sec-Websocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	header.Set("Authorization", "Bearer should-be-stripped")
+	header.Set("Keep-Alive", "timeout=5")
+	header.Set("X-Not-Allowed", "should-be-stripped")
+
+	p.filterHeaders(header)
+
+	for _, h := range []string{"Accept", "X-Stream-Protocol-Version", "Sec-Websocket-Protocol", "Sec-Websocket-Key"} {
+		if header.Get(h) == "" {
+			t.Errorf("expected allow-listed header %q to survive filterHeaders", h)
+		}
+	}
+
+	for _, h := range []string{"Authorization", "Keep-Alive", "X-Not-Allowed"} {
+		if header.Get(h) != "" {
+			t.Errorf("expected header %q to be stripped by filterHeaders", h)
+		}
+	}
+}
+
+// TestAuthenticateAndRoundTrip_CertFailureFallsThroughToOIDC checks that a
+// client certificate which the client certificate authenticator does not
+// accept (ok=false, no error) falls through to the OIDC bearer token path,
+// rather than short-circuiting to errUnauthorized.
+func TestAuthenticateAndRoundTrip_CertFailureFallsThroughToOIDC(t *testing.T) {
+	p, rts := newTestProxy()
+	p.clientCertAuther = &fakeRequestAuther{ok: false, err: nil}
+	p.oidcRequestAuther = newFakeBearerAuther(t, &authuser.DefaultInfo{Name: "alice"})
+
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/api/v1/pods", nil)
+	req.Header.Set("Authorization", "Bearer valid-oidc-token")
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{}}}
+
+	resp, username, _, err := p.authenticateAndRoundTrip(req)
+	if err != nil {
+		t.Fatalf("expected fallthrough to OIDC to succeed, got err: %s", err)
+	}
+	if resp == nil {
+		t.Fatal("expected a response from the OIDC path")
+	}
+	if username != "alice" {
+		t.Errorf("expected username %q from OIDC path, got %q", "alice", username)
+	}
+	if !rts.client.called {
+		t.Error("expected the OIDC-authenticated request to be proxied through clientTransport")
+	}
+}
+
+// TestRoundTripWithIdentity_UIDPassthroughUsesUpgradeTransport checks that a
+// PassthroughUIDBearing upgrade request (exec/attach/port-forward/logs -f
+// carried over a UID-bearing token) is routed through the HTTP/1.1 upgrade
+// transport, not the regular no-auth transport.
+func TestRoundTripWithIdentity_UIDPassthroughUsesUpgradeTransport(t *testing.T) {
+	p, rts := newTestProxy()
+	p.options.PassthroughUIDBearing = true
+
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/api/v1/pods/foo/exec", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "SPDY/3.1")
+
+	user := &authuser.DefaultInfo{Name: "alice", UID: "abc-123"}
+
+	if _, err := p.roundTripWithIdentity(req, req, user); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if !rts.noAuthUpgrade.called {
+		t.Error("expected the UID-passthrough upgrade request to be routed through noAuthUpgradeClientTransport")
+	}
+	if rts.noAuth.called {
+		t.Error("expected the UID-passthrough upgrade request NOT to be routed through the non-upgrade no-auth transport")
+	}
+}
+
+// TestRoundTripWithIdentity_PassthroughIsRateLimitedAndCounted checks that
+// the DisableImpersonation passthrough path is still subject to the
+// per-username rate limit and counted in AuthenticationOutcomes, not just
+// impersonated requests.
+func TestRoundTripWithIdentity_PassthroughIsRateLimitedAndCounted(t *testing.T) {
+	p, rts := newTestProxy()
+	p.options.DisableImpersonation = true
+	p.options.RateLimitQPS = 1
+	p.options.RateLimitBurst = 1
+
+	user := &authuser.DefaultInfo{Name: "alice"}
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/api/v1/pods", nil)
+
+	before := testutil.ToFloat64(metrics.AuthenticationOutcomes.WithLabelValues(metrics.OutcomeSuccess, ""))
+
+	if _, err := p.roundTripWithIdentity(req, req, user); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !rts.noAuth.called {
+		t.Fatal("expected the first request to be forwarded")
+	}
+
+	if after := testutil.ToFloat64(metrics.AuthenticationOutcomes.WithLabelValues(metrics.OutcomeSuccess, "")); after != before+1 {
+		t.Errorf("expected AuthenticationOutcomes success count to increase by 1, got %v -> %v", before, after)
+	}
+
+	rts.noAuth.called = false
+	resp, err := p.roundTripWithIdentity(req, req, user)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected the second request to be rate limited, got %+v", resp)
+	}
+	if rts.noAuth.called {
+		t.Error("expected the rate limited request not to reach the transport")
+	}
+}
+
+// TestRoundTripWithIdentity_ImpersonatedUpgradeRequest checks that an
+// impersonated upgrade request (e.g. kubectl exec/port-forward) is routed
+// through the HTTP/1.1 upgrade transport, not the regular impersonated
+// transport - the combination an authenticated exec/attach/port-forward
+// request actually hits, as opposed to the no-impersonation passthrough and
+// plain impersonated cases covered above.
+func TestRoundTripWithIdentity_ImpersonatedUpgradeRequest(t *testing.T) {
+	p, rts := newTestProxy()
+
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/api/v1/pods/foo/exec", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "SPDY/3.1")
+
+	user := &authuser.DefaultInfo{Name: "alice"}
+
+	if _, err := p.roundTripWithIdentity(req, req, user); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if !rts.upgrade.called {
+		t.Error("expected the impersonated upgrade request to be routed through upgradeClientTransport")
+	}
+	if rts.client.called {
+		t.Error("expected the impersonated upgrade request NOT to be routed through the non-upgrade transport")
+	}
+}
+
+// TestRateLimitResponse checks that a request within the token bucket's
+// burst is let through, and the next one, over the limit, is rejected with
+// a 429 and Retry-After header.
+func TestRateLimitResponse(t *testing.T) {
+	p := &Proxy{options: &Options{RateLimitQPS: 1, RateLimitBurst: 1}}
+
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/api/v1/pods", nil)
+
+	if resp := p.rateLimitResponse(req, "alice"); resp != nil {
+		t.Fatalf("expected first request within burst to be let through, got status %d", resp.StatusCode)
+	}
+
+	resp := p.rateLimitResponse(req, "alice")
+	if resp == nil {
+		t.Fatal("expected second request over burst to be rate limited")
+	}
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("expected status %d, got %d", http.StatusTooManyRequests, resp.StatusCode)
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Error("expected a Retry-After header on the rate limited response")
+	}
+}
+
+// TestAuditHandler_NoPolicyIsNoop checks that auditHandler returns a
+// non-nil handler and no error when no AuditPolicyFile is configured.
+func TestAuditHandler_NoPolicyIsNoop(t *testing.T) {
+	p := &Proxy{options: &Options{}}
+
+	inner := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})
+	got, err := p.auditHandler(inner)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if got == nil {
+		t.Fatal("expected a non-nil handler")
+	}
+}
+
+// TestAuditHandler_InvalidPolicyFileErrors checks that auditHandler surfaces
+// an error rather than silently disabling audit logging when
+// AuditPolicyFile is set but cannot be loaded.
+func TestAuditHandler_InvalidPolicyFileErrors(t *testing.T) {
+	p := &Proxy{options: &Options{AuditPolicyFile: "/does/not/exist.yaml"}}
+
+	if _, err := p.auditHandler(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})); err == nil {
+		t.Fatal("expected an error for a missing audit policy file")
+	}
+}
+
+// newRequestWithAuditEvent returns a request carrying an empty audit event
+// in its context, mirroring the context plumbing filters.WithAudit performs
+// in production, so auditAuthenticatedUser/auditImpersonatedUser have
+// something to populate.
+func newRequestWithAuditEvent(t *testing.T) (*http.Request, *auditv1.Event) {
+	t.Helper()
+
+	ctx := audit.WithAuditContext(context.Background())
+	audit.AuditContextFrom(ctx).Event = auditv1.Event{}
+
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/api/v1/pods", nil).WithContext(ctx)
+	return req, audit.AuditEventFrom(ctx)
+}
+
+// TestAuditAuthenticatedUser checks that auditAuthenticatedUser populates the
+// request's audit event with the authenticated user's identity.
+func TestAuditAuthenticatedUser(t *testing.T) {
+	req, ev := newRequestWithAuditEvent(t)
+
+	user := &authuser.DefaultInfo{
+		Name:   "alice",
+		UID:    "abc-123",
+		Groups: []string{"system:masters"},
+		Extra:  map[string][]string{"foo": {"bar"}},
+	}
+
+	auditAuthenticatedUser(req, user)
+
+	if ev.User.Username != "alice" || ev.User.UID != "abc-123" {
+		t.Errorf("expected audit event user %q (uid %q), got %+v", "alice", "abc-123", ev.User)
+	}
+	if vs := ev.User.Extra["foo"]; len(vs) != 1 || vs[0] != "bar" {
+		t.Errorf("expected audit event user extra %q, got %v", "bar", ev.User.Extra)
+	}
+}
+
+// TestAuditAuthenticatedUser_NoAuditEventIsNoop checks that
+// auditAuthenticatedUser doesn't panic when called on a request with no
+// audit event in context, e.g. because audit logging is disabled.
+func TestAuditAuthenticatedUser_NoAuditEventIsNoop(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/api/v1/pods", nil)
+	auditAuthenticatedUser(req, &authuser.DefaultInfo{Name: "alice"})
+}
+
+// TestAuditImpersonatedUser checks that auditImpersonatedUser populates the
+// request's audit event with the identity being impersonated to the API
+// server.
+func TestAuditImpersonatedUser(t *testing.T) {
+	req, ev := newRequestWithAuditEvent(t)
+
+	conf := transport.ImpersonationConfig{
+		UserName: "alice",
+		Groups:   []string{"system:masters"},
+	}
+
+	auditImpersonatedUser(req, conf)
+
+	if ev.ImpersonatedUser == nil {
+		t.Fatal("expected ImpersonatedUser to be set")
+	}
+	if ev.ImpersonatedUser.Username != "alice" {
+		t.Errorf("expected impersonated username %q, got %q", "alice", ev.ImpersonatedUser.Username)
+	}
+}